@@ -0,0 +1,198 @@
+// Package passwd is a pure-Go reader for /etc/passwd and /etc/group,
+// inspired by libcontainer's user package. It exists so callers don't have
+// to shell out to grep or cut (not guaranteed to exist on minimal container
+// images) to get at account and group membership data.
+package passwd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PasswdEntry is a single parsed /etc/passwd record.
+type PasswdEntry struct {
+	Name  string
+	Pass  string
+	UID   int
+	GID   int
+	Gecos string
+	Home  string
+	Shell string
+}
+
+// GroupEntry is a single parsed /etc/group record.
+type GroupEntry struct {
+	Name    string
+	Pass    string
+	GID     int
+	Members []string
+}
+
+// ParsePasswd reads and parses a passwd-formatted file, e.g. /etc/passwd.
+func ParsePasswd(path string) ([]PasswdEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []PasswdEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("malformed passwd line: %q", line)
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("malformed uid in passwd line: %q", line)
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed gid in passwd line: %q", line)
+		}
+		entries = append(entries, PasswdEntry{
+			Name:  fields[0],
+			Pass:  fields[1],
+			UID:   uid,
+			GID:   gid,
+			Gecos: fields[4],
+			Home:  fields[5],
+			Shell: fields[6],
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// ParseGroup reads and parses a group-formatted file, e.g. /etc/group.
+func ParseGroup(path string) ([]GroupEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []GroupEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("malformed group line: %q", line)
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("malformed gid in group line: %q", line)
+		}
+		var members []string
+		if fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, GroupEntry{
+			Name:    fields[0],
+			Pass:    fields[1],
+			GID:     gid,
+			Members: members,
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// Users parses /etc/passwd.
+func Users() ([]PasswdEntry, error) {
+	return ParsePasswd("/etc/passwd")
+}
+
+// Groups parses /etc/group.
+func Groups() ([]GroupEntry, error) {
+	return ParseGroup("/etc/group")
+}
+
+// ByName returns the passwd entry with the given username, if any.
+func ByName(entries []PasswdEntry, name string) (PasswdEntry, bool) {
+	for _, e := range entries {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return PasswdEntry{}, false
+}
+
+// ByUID returns the passwd entry with the given uid, if any.
+func ByUID(entries []PasswdEntry, uid int) (PasswdEntry, bool) {
+	for _, e := range entries {
+		if e.UID == uid {
+			return e, true
+		}
+	}
+	return PasswdEntry{}, false
+}
+
+// GroupByName returns the group entry with the given name, if any.
+func GroupByName(groups []GroupEntry, name string) (GroupEntry, bool) {
+	for _, g := range groups {
+		if g.Name == name {
+			return g, true
+		}
+	}
+	return GroupEntry{}, false
+}
+
+// GroupByGID returns the group entry with the given gid, if any.
+func GroupByGID(groups []GroupEntry, gid int) (GroupEntry, bool) {
+	for _, g := range groups {
+		if g.GID == gid {
+			return g, true
+		}
+	}
+	return GroupEntry{}, false
+}
+
+// InGroup reports whether user is a primary or supplementary member of group.
+func InGroup(user PasswdEntry, group GroupEntry) bool {
+	if user.GID == group.GID {
+		return true
+	}
+	for _, m := range group.Members {
+		if m == user.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// RunningInContainer reports whether the current process appears to be
+// running inside a Docker container, checked in-process rather than by
+// shelling out to grep.
+func RunningInContainer() (bool, error) {
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return true, nil
+	}
+
+	f, err := os.Open("/proc/1/cgroup")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), "docker") {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
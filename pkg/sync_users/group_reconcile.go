@@ -0,0 +1,137 @@
+package sync_users
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/appvia/aws_usersync/pkg/log"
+	"github.com/appvia/aws_usersync/pkg/passwd"
+)
+
+// MembershipPolicy controls how a user's supplementary group membership is
+// reconciled against Groups.
+type MembershipPolicy int
+
+const (
+	// Additive only adds missing groups; memberships not listed in Groups
+	// are left alone.
+	Additive MembershipPolicy = iota
+	// Exclusive adds missing groups and revokes membership of any group not
+	// listed in Groups, so e.g. a user demoted out of an IAM group loses
+	// sudo rather than keeping it forever.
+	Exclusive
+)
+
+// reconcileGroups ensures every group in l.Groups (other than those in
+// IgnoredGroups) exists and the user is a member of it, creating groups as
+// needed. On Exclusive policy it also
+// revokes membership of any group the user currently belongs to that isn't
+// in l.Groups (and isn't in IgnoredGroups). This runs on every sync pass, not
+// just at user creation, so membership mirrors the IAM-group mapping even as
+// it changes over time.
+func (l *awsUser) reconcileGroups() error {
+	groups, err := passwd.Groups()
+	if err != nil {
+		return err
+	}
+
+	self, err := currentUser(l.localUser.Username)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range l.Groups {
+		if stringInSlice(g, l.IgnoredGroups) {
+			continue
+		}
+		entry, ok := passwd.GroupByName(groups, g)
+		if !ok {
+			if err := createGroup(GroupSpec{Name: g}); err != nil {
+				return err
+			}
+			entry = passwd.GroupEntry{Name: g}
+			groups = append(groups, entry)
+		}
+
+		if passwd.InGroup(self, entry) {
+			continue
+		}
+		log.Info(fmt.Sprintf("Adding user %v to %v group", l.localUser.Username, g))
+		if err := addUserToGroup(l.localUser.Username, g); err != nil {
+			return err
+		}
+	}
+
+	if l.GroupPolicy != Exclusive {
+		return nil
+	}
+
+	for _, g := range groups {
+		// Skip the primary group by gid, not by l.Group's name: an adopted
+		// pre-existing user's actual primary group (self.GID) may not be
+		// l.Group, and removeUserFromGroup would fail trying to revoke
+		// membership of a group the user was never a supplementary member of.
+		if g.GID == self.GID || !passwd.InGroup(self, g) {
+			continue
+		}
+		if stringInSlice(g.Name, l.IgnoredGroups) || stringInSlice(g.Name, l.Groups) {
+			continue
+		}
+		log.Info(fmt.Sprintf("Removing user %v from %v group", l.localUser.Username, g.Name))
+		if err := removeUserFromGroup(l.localUser.Username, g.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentUser looks up a single passwd entry by name. Supplementary group
+// membership lives in /etc/group, not here - this is only used for the
+// user's name and primary gid, neither of which change mid-reconcile.
+func currentUser(name string) (passwd.PasswdEntry, error) {
+	entries, err := passwd.Users()
+	if err != nil {
+		return passwd.PasswdEntry{}, err
+	}
+	entry, ok := passwd.ByName(entries, name)
+	if !ok {
+		return passwd.PasswdEntry{}, fmt.Errorf("user %v not found while reconciling group membership", name)
+	}
+	return entry, nil
+}
+
+// addUserToGroup issues the platform-appropriate command to add an existing
+// user to an existing group. GNU shadow-utils has no standalone "add this
+// user to that group" command, so it goes through usermod; busybox has no
+// usermod at all, but addgroup doubles as "add user to group" when given two
+// names.
+func addUserToGroup(username, group string) error {
+	if hostIsContainer {
+		if _, err := exec.Command(groupAddCmd, username, group).Output(); err != nil {
+			log.Error(fmt.Sprintf("Error adding user %v to group %v", username, group))
+			return err
+		}
+		return nil
+	}
+	args := []string{"-a", "-G", group, username}
+	if _, err := exec.Command(userModCmd, args...).Output(); err != nil {
+		log.Error(fmt.Sprintf("Error adding user %v to group %v", username, group))
+		return err
+	}
+	return nil
+}
+
+// removeUserFromGroup issues the platform-appropriate command to revoke a
+// user's membership of a group without deleting the user or the group.
+func removeUserFromGroup(username, group string) error {
+	// gpasswd takes "-d user group"; alpine's deluser takes "user group".
+	args := []string{username, group}
+	if groupDelCmd == "gpasswd" {
+		args = []string{"-d", username, group}
+	}
+	if _, err := exec.Command(groupDelCmd, args...).Output(); err != nil {
+		log.Error(fmt.Sprintf("Error removing user %v from group %v", username, group))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package sync_users
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/appvia/aws_usersync/pkg/log"
+)
+
+// managedMarker tags a line in authorized_keys as one this tool owns, so a
+// later run can tell its own keys apart from ones a user added by hand.
+const managedMarker = "managed-by=aws_usersync"
+
+// Get the keys of user if there are any locally if not then add keys from the key source.
+// if there are managed keys for the user then compare them with the source's keys and, if
+// they differ in any way, replace the managed keys with the source's
+func (l *awsUser) DoKeys() error {
+	sourceKeys, err := l.source.KeysFor(l.iamUser)
+	if err != nil {
+		return err
+	}
+
+	keyPath := authKeysFilePath(l.localUser)
+	keys, preserved, _ := l.getKeys(keyPath)
+	writekeys := true
+	if keys != nil {
+		if len(keys) == len(sourceKeys) && len(GetArrayDiff(keys, sourceKeys)) == 0 {
+			writekeys = false
+			log.Debug("No new keys found, nothing to do")
+		} else {
+			keys = sourceKeys
+		}
+	} else {
+		keys = sourceKeys
+	}
+	if writekeys == true {
+		if err := Keys(l.iamUser, l.localUser, keyPath, keys, preserved); err != nil {
+			return err
+		}
+		log.Debug(fmt.Sprintf("Adding keys %v for %v", keys, l.localUser.Username))
+	}
+	return nil
+}
+
+// Check if there is the authorized keys file and, if so, split it into keys
+// this tool manages (identified by the trailing managed-by marker, with the
+// marker stripped) and any other non-blank lines, which are preserved
+// untouched. Blank lines are dropped.
+func (l *awsUser) getKeys(keyPath string) (managed []string, preserved []string, err error) {
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	kfile, err := os.Open(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer kfile.Close()
+
+	scanner := bufio.NewScanner(kfile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if key, ok := stripManagedMarker(line); ok {
+			managed = append(managed, key)
+		} else if line != "" {
+			preserved = append(preserved, line)
+		}
+	}
+	log.Debug(fmt.Sprintf("Current managed keys on host for %v  : %v", keyPath, managed))
+	return managed, preserved, scanner.Err()
+}
+
+// markedLine renders a key with its managed-by marker, including a
+// fingerprint so the key material itself can be verified at a glance.
+func markedLine(iamUser string, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	fp := hex.EncodeToString(sum[:])
+	return fmt.Sprintf("%s # %s iam=%s fp=%s", key, managedMarker, iamUser, fp)
+}
+
+// stripManagedMarker returns the key material with the trailing managed-by
+// marker comment removed, and whether the line carried that marker at all.
+func stripManagedMarker(line string) (string, bool) {
+	idx := strings.Index(line, "# "+managedMarker)
+	if idx == -1 {
+		return "", false
+	}
+	return strings.TrimSpace(line[:idx]), true
+}
+
+// Loop through the keys and write them to the authorized_keys file. Writes
+// go to a temp file in the same directory, which is fsync'd and renamed over
+// the real file, so a crash mid-write can never leave the user with a
+// truncated (and so unusable) authorized_keys. Lines the tool doesn't manage
+// are preserved as-is.
+func Keys(iamUser string, l *user.User, kp string, ks []string, preserved []string) error {
+	// create ssh directory if needed
+	if err := os.MkdirAll(sshDirPath(l), 0700); err != nil {
+		log.Debug(fmt.Sprintf("Error creating %v", sshDirPath(l)))
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(sshDirPath(l), "."+AuthorizedKeysFile+".")
+	if err != nil {
+		log.Error(fmt.Sprintf("Error creating temp file for %v", kp))
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	w := bufio.NewWriter(tmp)
+	for _, k := range ks {
+		fmt.Fprintln(w, markedLine(iamUser, k))
+		log.Info(fmt.Sprintf("Updating key %s for user %s", truncate(k, 20), l.Username))
+	}
+	for _, line := range preserved {
+		fmt.Fprintln(w, line)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := setPerms(l, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, kp); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	dir, err := os.Open(sshDirPath(l))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// truncate returns the first n bytes of s, or the whole string if it's
+// shorter than n.
+func truncate(s string, n int) string {
+	if len(s) < n {
+		return s
+	}
+	return s[:n]
+}
+
+// Set permissions on file
+func setPerms(u *user.User, keypath string) error {
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(keypath, uid, gid); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package sync_users
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/appvia/aws_usersync/pkg/log"
+	"github.com/appvia/aws_usersync/pkg/passwd"
+)
+
+// defaultShell is used for new users when UserSpec.Shell is left blank.
+const defaultShell = "/bin/bash"
+
+// noPasswordHash disables password login while still allowing key-based
+// login, matching the behaviour of passwd's "*" entry.
+const noPasswordHash = "*"
+
+// GroupSpec describes the desired state of a single /etc/group entry.
+type GroupSpec struct {
+	Name   string
+	GID    int // 0 means "let the system pick one"
+	System bool
+}
+
+// UserSpec describes the desired state of a single /etc/passwd entry.
+type UserSpec struct {
+	Name         string
+	UID          int // 0 means "let the system pick one"
+	PrimaryGroup string
+	GECOS        string
+	Shell        string
+	HomeDir      string
+	System       bool
+	Groups       []string // supplementary groups
+	PasswordHash string
+	NoPassword   bool // if true, PasswordHash is ignored and login is key-only
+}
+
+// PasswdSpec is the declarative, Ignition-style description of the users and
+// groups that should exist on the host. Reconcile checks it against
+// /etc/passwd and /etc/group and only creates the groups and users that are
+// missing, rather than blindly running useradd/adduser every time. A user
+// that already exists is not compared field by field: outside a container,
+// usermod is run for it on every call, whether or not it differs from the
+// spec. Existing groups are never modified.
+type PasswdSpec struct {
+	Users  []UserSpec
+	Groups []GroupSpec
+}
+
+// Reconcile converges the host's users and groups onto the spec.
+func (s *PasswdSpec) Reconcile() error {
+	existingGroups, err := passwd.Groups()
+	if err != nil {
+		return err
+	}
+	existingUsers, err := passwd.Users()
+	if err != nil {
+		return err
+	}
+
+	// Create any missing groups first - every user's primary group must
+	// exist before the user does, otherwise useradd fails outright.
+	for _, g := range s.Groups {
+		if entry, ok := passwd.GroupByName(existingGroups, g.Name); ok {
+			if g.GID != 0 && entry.GID != g.GID {
+				return fmt.Errorf("group %v already exists with gid %v, spec wants %v", g.Name, entry.GID, g.GID)
+			}
+			continue
+		}
+		if g.GID != 0 {
+			if owner, taken := passwd.GroupByGID(existingGroups, g.GID); taken {
+				return fmt.Errorf("gid %v requested for group %v is already used by group %v", g.GID, g.Name, owner.Name)
+			}
+		}
+		if err := createGroup(g); err != nil {
+			return err
+		}
+		existingGroups = append(existingGroups, passwd.GroupEntry{Name: g.Name, GID: g.GID})
+	}
+
+	for _, u := range s.Users {
+		if u.PrimaryGroup == "" {
+			return fmt.Errorf("user %v has no primary group set", u.Name)
+		}
+		if _, ok := passwd.GroupByName(existingGroups, u.PrimaryGroup); !ok {
+			return fmt.Errorf("primary group %v for user %v does not exist and is not declared in the spec", u.PrimaryGroup, u.Name)
+		}
+
+		if u.UID != 0 {
+			if owner, taken := passwd.ByUID(existingUsers, u.UID); taken && owner.Name != u.Name {
+				return fmt.Errorf("uid %v requested for user %v is already used by user %v", u.UID, u.Name, owner.Name)
+			}
+		}
+
+		if _, ok := passwd.ByName(existingUsers, u.Name); ok {
+			if err := modifyUser(u); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := createUser(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createGroup issues groupadd (or the busybox addgroup equivalent) for a
+// group that doesn't exist yet. The two accept different flags for marking a
+// system group, so this branches on hostIsContainer rather than sharing args.
+func createGroup(g GroupSpec) error {
+	log.Info(fmt.Sprintf("Creating group %v", g.Name))
+	var args []string
+	if g.GID != 0 {
+		args = append(args, "-g", strconv.Itoa(g.GID))
+	}
+	if g.System {
+		if hostIsContainer {
+			args = append(args, "-S")
+		} else {
+			args = append(args, "-r")
+		}
+	}
+	args = append(args, g.Name)
+	if _, err := exec.Command(groupAddCmd, args...).Output(); err != nil {
+		log.Error(fmt.Sprintf("Error creating group %v", g.Name))
+		return err
+	}
+	return nil
+}
+
+// createUser issues useradd (or the busybox adduser equivalent) for a user
+// that doesn't exist yet. busybox adduser only accepts a single group at
+// creation time, so in that mode any extra supplementary groups are applied
+// afterwards with addUserToGroup.
+func createUser(u UserSpec) error {
+	log.Info(fmt.Sprintf("Creating user %v", u.Name))
+	var args []string
+	if hostIsContainer {
+		args = busyboxCreateArgs(u)
+	} else {
+		args = gnuCreateArgs(u)
+	}
+	args = append(args, u.Name)
+	if _, err := exec.Command(userAddCmd, args...).Output(); err != nil {
+		log.Error(fmt.Sprintf("Error creating user %v", u.Name))
+		return err
+	}
+
+	if hostIsContainer {
+		for _, g := range u.Groups {
+			if g == u.PrimaryGroup {
+				continue
+			}
+			if err := addUserToGroup(u.Name, g); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// modifyUser issues usermod to bring an existing user's primary group,
+// supplementary groups, shell and password in line with the spec. busybox
+// has no usermod at all, so updating an existing user in a container isn't
+// supported - the user's state from creation time is left as-is.
+func modifyUser(u UserSpec) error {
+	if hostIsContainer {
+		log.Debug(fmt.Sprintf("usermod is not available in containers, skipping update for existing user %v", u.Name))
+		return nil
+	}
+	args := gnuModifyArgs(u)
+	args = append(args, u.Name)
+	if _, err := exec.Command(userModCmd, args...).Output(); err != nil {
+		log.Error(fmt.Sprintf("Error updating user %v", u.Name))
+		return err
+	}
+	return nil
+}
+
+// gnuCreateArgs builds useradd flags for a new user on a GNU shadow-utils host.
+func gnuCreateArgs(u UserSpec) []string {
+	args := gnuModifyArgs(u)
+	if u.HomeDir != "" {
+		args = append(args, "-d", u.HomeDir)
+	}
+	if !u.System {
+		args = append(args, "-m")
+	}
+	return args
+}
+
+// gnuModifyArgs builds the useradd/usermod flags shared by creating and
+// updating a user on a GNU shadow-utils host. Home directory flags are
+// deliberately excluded: usermod -m is only valid alongside -d, and this
+// tool doesn't move an existing user's home, so they're added separately by
+// gnuCreateArgs for the create-only path.
+func gnuModifyArgs(u UserSpec) []string {
+	var args []string
+	if u.UID != 0 {
+		args = append(args, "-u", strconv.Itoa(u.UID))
+	}
+	args = append(args, "-g", u.PrimaryGroup)
+	if len(u.Groups) > 0 {
+		args = append(args, "-G", strings.Join(u.Groups, ","))
+	}
+	shell := u.Shell
+	if shell == "" {
+		shell = defaultShell
+	}
+	args = append(args, "-s", shell)
+	if u.GECOS != "" {
+		args = append(args, "-c", u.GECOS)
+	}
+	pass := u.PasswordHash
+	if u.NoPassword || pass == "" {
+		pass = noPasswordHash
+	}
+	args = append(args, "-p", pass)
+	return args
+}
+
+// busyboxCreateArgs builds adduser flags for a new user on an Alpine/busybox
+// host. busybox adduser has no -d/-m/-c/-p/-G(multi) - home is always
+// created unless -H is passed, -G takes the single primary group, GECOS is
+// set with -g, and -D skips setting a password (key-based login still
+// works).
+func busyboxCreateArgs(u UserSpec) []string {
+	var args []string
+	if u.UID != 0 {
+		args = append(args, "-u", strconv.Itoa(u.UID))
+	}
+	args = append(args, "-G", u.PrimaryGroup)
+	shell := u.Shell
+	if shell == "" {
+		shell = defaultShell
+	}
+	args = append(args, "-s", shell)
+	if u.GECOS != "" {
+		args = append(args, "-g", u.GECOS)
+	}
+	if u.HomeDir != "" {
+		args = append(args, "-h", u.HomeDir)
+	}
+	if u.System {
+		args = append(args, "-S")
+	}
+	args = append(args, "-D")
+	return args
+}
@@ -1,16 +1,13 @@
 package sync_users
 
 import (
-	"bufio"
 	"fmt"
-	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
-	"strconv"
-	"strings"
 
 	"github.com/appvia/aws_usersync/pkg/log"
+	"github.com/appvia/aws_usersync/pkg/passwd"
 )
 
 // Constants AuthorizedKeysFile and the sshdir extension
@@ -19,14 +16,20 @@ const (
 	SSHDir             = ".ssh"
 )
 
-// Define variables for host commands and arguments
+// Define variables for host commands, resolved once in setHostCommands
+// and used by the PasswdSpec reconciler to create/update users and groups.
 var (
-	userAddCmd string
+	userAddCmd  string
+	userModCmd  string
 	groupAddCmd string
-	userDelCmd string
-	userAddArgs []string
-	groupAddArgs []string
+	groupDelCmd string
+	userDelCmd  string
 	userDelArgs []string
+
+	// hostIsContainer records whether we're running the busybox/Alpine
+	// toolset rather than GNU shadow-utils, since the two accept
+	// incompatible flag syntax (see passwd_spec.go and group_reconcile.go).
+	hostIsContainer bool
 )
 
 // UserList structure to hold the details of aws users, local users and ignored users
@@ -37,11 +40,13 @@ type UserList struct {
 }
 
 type awsUser struct {
-	iamUser   string
-	Group     string
-	SudoGroup string
-	Keys      []string
-	localUser *user.User
+	iamUser       string
+	Group         string
+	Groups        []string
+	GroupPolicy   MembershipPolicy
+	IgnoredGroups []string
+	source        KeySource
+	localUser     *user.User
 }
 
 func init() {
@@ -53,62 +58,58 @@ func init() {
 // alpine's commands are slightly different to other linux distros so if we're running inside
 // a docker container, set the exec commands to the alpine versions
 func setHostCommands() error {
-	container, err := runningInContainer()
+	container, err := passwd.RunningInContainer()
 	if err != nil {
 		log.Error("Could not determine if running inside a docker container or not")
 		return err
 	}
+	hostIsContainer = container
 
 	if container == true {
 		// set to alpine commands
 		log.Debug("Running in a container, using alpine Linux commands...")
 		userAddCmd = "adduser"
-		userAddArgs = []string{"-D", "-s", "/bin/bash"} // don't set a password, set login shell to /bin/bash
+		userModCmd = "usermod"
 		groupAddCmd = "addgroup"
+		groupDelCmd = "deluser" // alpine's deluser also removes a user from a single group
 		userDelCmd = "deluser"
 		userDelArgs = []string{"--remove-home"}
 	} else {
 		log.Debug("Not running in a container, using standard Linux commands...")
 		userAddCmd = "useradd"
-		userAddArgs = []string{"-p", "123", "-U", "-m"} // set pass to 123, create home dir
-		groupAddCmd = "usermod"
-		groupAddArgs = []string{"-a", "-G"}
+		userModCmd = "usermod"
+		groupAddCmd = "groupadd"
+		groupDelCmd = "gpasswd"
 		userDelCmd = "userdel"
 		userDelArgs = []string{"-r"}
 	}
 	return nil
 }
 
-// Check whether this is running in a docker container or not
-func runningInContainer() (bool, error) {
-	_, err := exec.Command("grep", "-q", "docker", "/proc/1/cgroup").Output()
-	if err != nil {
-		if err.Error() == "exit status 1" {
-			// not running in a docker container
-			return false, nil
-		} else {
-			// something went wrong
-			return false, err
-		}
-	} else {
-		// running in a docker container
-		return true, nil
-	}
-}
-
-// Initiate the user function
-func New(user string, group string, sgroup string, keys []string) *awsUser {
+// Initiate the user function. source is consulted for this user's keys on
+// every sync pass, so operators can mix key sources (IAM, GitHub, GitLab,
+// file) per group rather than being tied to AWS IAM. groups and policy
+// mirror the user's IAM group membership onto local groups (e.g. sudo) every
+// sync pass rather than only at creation time.
+func New(user string, group string, groups []string, policy MembershipPolicy, ignoredGroups []string, source KeySource) *awsUser {
 	ustruct := &awsUser{
-		iamUser:   user,
-		Group:     group,
-		SudoGroup: sgroup,
-		Keys:      keys,
+		iamUser:       user,
+		Group:         group,
+		Groups:        groups,
+		GroupPolicy:   policy,
+		IgnoredGroups: ignoredGroups,
+		source:        source,
 	}
 	return ustruct
 }
 
-// Create a compare structure
-func CmpNew(iams []string, ignore []string) (*UserList, error) {
+// Create a compare structure. users are listed from source rather than
+// assumed to be AWS IAM users.
+func CmpNew(source KeySource, ignore []string) (*UserList, error) {
+	iams, err := source.ListUsers()
+	if err != nil {
+		return nil, err
+	}
 	local, err := GetAllUsers()
 	if err != nil {
 		return nil, err
@@ -200,142 +201,47 @@ func GetArrayDiff(k1 []string, k2 []string) []string {
 	return diff
 }
 
-// Loop through the keys and call add key to add key to the box
-func Keys(l *user.User, kp string, ks []string) error {
-	// create ssh directory if needed
-	if err := os.MkdirAll(sshDirPath(l), 700); err != nil {
-		log.Debug(fmt.Sprintf("Error creating %v", sshDirPath(l)))
-		return err
-	}
-
-	f, err := os.Create(kp)
-	defer f.Close()
-	if err != nil {
-		log.Error(fmt.Sprintf("Error creating %v", kp))
-		return err
-	}
-	log.Debug(fmt.Sprintf("Created file %v writing keys %v", kp, ks))
-	w := bufio.NewWriter(f)
-	for _, k := range ks {
-		fmt.Fprintln(w, k)
-		log.Info(fmt.Sprintf("Updating key %s for user %s", k[0:20], l.Username))
-	}
-	w.Flush()
-	if err := setPerms(l, kp); err != nil {
-		return err
-	}
-	return nil
-}
-
-// Set permissions on file
-func setPerms(u *user.User, keypath string) error {
-	gid, err := strconv.Atoi(u.Gid)
-	uid, err := strconv.Atoi(u.Uid)
-	if err != nil {
-		return err
-	}
-	if err := os.Chown(keypath, uid, gid); err != nil {
-		return err
-	}
-	return nil
-}
-
-// Get the keys of user if there are any locally if not then add keys from iam.
-// if there are keys for the user then find out if there are more local keys than there are in iam in which case
-// set it to replace the keys
-func (l *awsUser) DoKeys() error {
-	keyPath := authKeysFilePath(l.localUser)
-	keys, _ := l.getKeys(keyPath)
-	writekeys := true
-	if keys != nil {
-		if len(keys) == len(l.Keys) {
-			if len(GetArrayDiff(keys, l.Keys)) == 0 {
-				writekeys = false
-				log.Debug("No new keys found, nothing to do")
-			}
-		} else {
-			keys = l.Keys
-		}
-	} else {
-		keys = l.Keys
-	}
-	if writekeys == true {
-		if err := Keys(l.localUser, keyPath, keys); err != nil {
-			return err
-		}
-		log.Debug(fmt.Sprintf("Adding keys %v for %v", keys, l.localUser.Username))
-	}
-	return nil
-}
-
-// Check if there is the authorized keys file if it is then return all the keys from it
-func (l *awsUser) getKeys(keyPath string) ([]string, error) {
-	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
-		return nil, err
-	} else {
-		kfile, err := os.Open(keyPath)
-		if err != nil {
-			return nil, err
-		}
-		defer kfile.Close()
-		var keys []string
-		scanner := bufio.NewScanner(kfile)
-		for scanner.Scan() {
-			keys = append(keys, scanner.Text())
-		}
-		log.Debug(fmt.Sprintf("Current keys on host for %v  : %v", keyPath, keys))
-		return keys, scanner.Err()
-	}
-}
-
+// GetAllUsers returns the usernames of every local account on the host.
 func GetAllUsers() ([]string, error) {
-	passwd := "/etc/passwd"
-	fpasswd, err := os.Open(passwd)
+	entries, err := passwd.Users()
 	if err != nil {
 		return nil, err
 	}
-	defer fpasswd.Close()
 	var users []string
-	scanner := bufio.NewScanner(fpasswd)
-	for scanner.Scan() {
-		users = append(users, strings.Split(scanner.Text(), ":")[0])
+	for _, e := range entries {
+		users = append(users, e.Name)
 	}
 	log.Debug(fmt.Sprintf("Got a list of local users: %v", users))
-	return users, scanner.Err()
+	return users, nil
 }
 
-// Add user onto the system
+// Add user onto the system, declaratively: the primary group and initial
+// supplementary groups are reconciled alongside the user itself rather than
+// shelled out to directly.
 func (l *awsUser) addUser() error {
 	if l.localUser == nil {
-		log.Info(fmt.Sprintf("Creating user %v", l.iamUser))
-
-		// put arguments in the correct order
-		CMD_ARGS := append(userAddArgs, l.iamUser)
-
-		_, err := exec.Command(userAddCmd, CMD_ARGS...).Output()
-		if err != nil {
+		groupSpecs := []GroupSpec{{Name: l.Group}}
+		for _, g := range l.Groups {
+			groupSpecs = append(groupSpecs, GroupSpec{Name: g})
+		}
+		spec := &PasswdSpec{
+			Groups: groupSpecs,
+			Users: []UserSpec{{
+				Name:         l.iamUser,
+				PrimaryGroup: l.Group,
+				Groups:       l.Groups,
+				NoPassword:   true,
+			}},
+		}
+		if err := spec.Reconcile(); err != nil {
 			return err
 		}
 
-		luser, _ := user.Lookup(l.iamUser)
-		l.localUser = luser
-	}
-	return nil
-}
-
-// Add user to sudo group
-func (l *awsUser) addUserToSudoGroup() error {
-	if l.localUser != nil {
-		log.Info(fmt.Sprintf("Adding user %v to %v group", l.localUser.Username, l.SudoGroup))
-
-		// put arguments in the correct order
-		CMD_ARGS := append([]string{l.localUser.Username}, groupAddArgs...)
-		CMD_ARGS = append(CMD_ARGS, l.SudoGroup)
-
-		_, err := exec.Command(groupAddCmd, CMD_ARGS...).Output()
+		luser, err := user.Lookup(l.iamUser)
 		if err != nil {
 			return err
 		}
+		l.localUser = luser
 	}
 	return nil
 }
@@ -349,15 +255,22 @@ func (l *awsUser) Sync() error {
 			log.Error("Failed trying to add user")
 			return err
 		}
-
-		if err := l.addUserToSudoGroup(); err != nil {
-			log.Error(fmt.Sprintf("Failed trying to add user %v to %v group", l.localUser.Username, l.SudoGroup))
-			return err
-		}
 	} else {
 		l.localUser = usr
 	}
 
+	if l.localUser == nil {
+		return fmt.Errorf("no local user resolved for %v after sync", l.iamUser)
+	}
+
+	// reconcile group membership every pass, not just at creation, so a
+	// user demoted out of an IAM group loses the local group (e.g. sudo)
+	// rather than keeping it forever.
+	if err := l.reconcileGroups(); err != nil {
+		log.Error(fmt.Sprintf("Failed trying to reconcile groups for %v", l.localUser.Username))
+		return err
+	}
+
 	if err := l.DoKeys(); err != nil {
 		log.Error("Failed on calling DoKeys")
 		return err